@@ -0,0 +1,75 @@
+// Package rain is a BitTorrent client library.
+package rain
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cenkalti/rain/internal/announcer"
+	"github.com/cenkalti/rain/internal/logger"
+	"github.com/cenkalti/rain/internal/peerlist"
+	"github.com/cenkalti/rain/internal/tracker"
+)
+
+// closer is implemented by announcer.Announcer and announcer.TrackerGroup:
+// anything a torrent registers with Client so Shutdown can wait for its
+// stopped-event announce to finish.
+type closer interface {
+	Closed() <-chan struct{}
+}
+
+// Client manages a set of torrents. Stopping an individual torrent returns
+// quickly; its stopped-event announce keeps running in the background, and
+// Shutdown is how callers wait for every torrent's to finish before the
+// process exits.
+type Client struct {
+	mu      sync.Mutex
+	closers []closer
+}
+
+// New creates an empty Client.
+func New() *Client {
+	return &Client{}
+}
+
+// trackCloser registers c so Shutdown waits for it. Called once per torrent
+// as it starts its announcer/tracker group.
+func (c *Client) trackCloser(cl closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closers = append(c.closers, cl)
+}
+
+// NewAnnouncer creates an Announcer for a torrent using a single tracker
+// and registers it with c, so Shutdown waits for its stopped-event
+// announce. A torrent must create its Announcer through here rather than
+// calling announcer.New directly, or Shutdown will never see it.
+func (c *Client) NewAnnouncer(trk tracker.Tracker, requests chan *announcer.Request, completedC chan struct{}, pl *peerlist.PeerList, l logger.Logger) *announcer.Announcer {
+	a := announcer.New(trk, requests, completedC, pl, l)
+	c.trackCloser(a)
+	return a
+}
+
+// NewTrackerGroup creates a TrackerGroup for a torrent's BEP 12
+// announce-list and registers it with c, so Shutdown waits for every
+// tier's stopped-event announce. A torrent must create its TrackerGroup
+// through here rather than calling announcer.NewTrackerGroup directly, or
+// Shutdown will never see it.
+func (c *Client) NewTrackerGroup(tiers [][]tracker.Tracker, requests chan *announcer.Request, completedC chan struct{}, pl *peerlist.PeerList, l logger.Logger) *announcer.TrackerGroup {
+	g := announcer.NewTrackerGroup(tiers, requests, completedC, pl, l)
+	c.trackCloser(g)
+	return g
+}
+
+// Shutdown blocks until every torrent's stopped-event announce has finished
+// (or been abandoned after its own timeout), or until ctx is done,
+// whichever comes first.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	closed := make([]<-chan struct{}, len(c.closers))
+	for i, cl := range c.closers {
+		closed[i] = cl.Closed()
+	}
+	c.mu.Unlock()
+	return announcer.WaitClosed(ctx, closed...)
+}
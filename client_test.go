@@ -0,0 +1,59 @@
+package rain
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeCloser is a minimal closer for testing Shutdown's blocking behavior
+// without needing a real Announcer/TrackerGroup and their tracker/peerlist
+// dependencies.
+type fakeCloser struct {
+	closedC chan struct{}
+}
+
+func (f *fakeCloser) Closed() <-chan struct{} {
+	return f.closedC
+}
+
+func TestShutdownWaitsForTrackedClosers(t *testing.T) {
+	c := New()
+	f := &fakeCloser{closedC: make(chan struct{})}
+	c.trackCloser(f)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned before its tracked closer closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(f.closedC)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown returned error after closer closed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after its tracked closer closed")
+	}
+}
+
+func TestShutdownRespectsContext(t *testing.T) {
+	c := New()
+	c.trackCloser(&fakeCloser{closedC: make(chan struct{})}) // never closed
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := c.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
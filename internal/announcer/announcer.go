@@ -1,10 +1,12 @@
 package announcer
 
 import (
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/cenkalti/rain/internal/logger"
+	"github.com/cenkalti/rain/internal/peer"
 	"github.com/cenkalti/rain/internal/peerlist"
 	"github.com/cenkalti/rain/internal/tracker"
 )
@@ -20,6 +22,9 @@ type Announcer struct {
 	backoff      backoff.BackOff
 	nextAnnounce time.Duration
 	requests     chan *Request
+
+	closeOnce sync.Once
+	closedC   chan struct{} // closed once the stopped-event announce (and tracker.Close) have finished
 }
 
 type Request struct {
@@ -37,14 +42,31 @@ func New(trk tracker.Tracker, requests chan *Request, completedC chan struct{},
 		completedC: completedC,
 		peerList:   pl,
 		requests:   requests,
-		backoff: &backoff.ExponentialBackOff{
-			InitialInterval:     5 * time.Second,
-			RandomizationFactor: 0.5,
-			Multiplier:          2,
-			MaxInterval:         30 * time.Minute,
-			MaxElapsedTime:      0, // never stop
-			Clock:               backoff.SystemClock,
-		},
+		backoff:    newBackOff(),
+		closedC:    make(chan struct{}),
+	}
+}
+
+// Closed returns a channel that is closed once this Announcer's
+// stopped-event announce has finished (or been abandoned after
+// stopEventTimeout) and its tracker has been closed. Callers that want to
+// wait for a graceful shutdown, such as Client.Shutdown, select on this
+// across every tracker of every torrent.
+func (a *Announcer) Closed() <-chan struct{} {
+	return a.closedC
+}
+
+// newBackOff returns the exponential back-off used between failed announces
+// to a single tracker. It never gives up; callers are expected to retry for
+// as long as the torrent/tier is running.
+func newBackOff() backoff.BackOff {
+	return &backoff.ExponentialBackOff{
+		InitialInterval:     5 * time.Second,
+		RandomizationFactor: 0.5,
+		Multiplier:          2,
+		MaxInterval:         30 * time.Minute,
+		MaxElapsedTime:      0, // never stop
+		Clock:               backoff.SystemClock,
 	}
 }
 
@@ -59,7 +81,10 @@ func (a *Announcer) Run(stopC chan struct{}) {
 			a.announce(tracker.EventCompleted, stopC)
 			a.completedC = nil
 		case <-stopC:
-			//a.announceStopAndClose() // TODO make async, don't wait
+			// Run returns immediately so the torrent isn't blocked on the
+			// stopped-event announce; it keeps going in the background,
+			// bounded by stopEventTimeout, and closedC reports when it's done.
+			go a.announceStopAndClose()
 			return
 		}
 	}
@@ -88,18 +113,21 @@ func (a *Announcer) announce(e tracker.Event, stopC chan struct{}) {
 		a.backoff.Reset()
 		a.nextAnnounce = r.Interval
 		select {
-		case a.peerList.NewPeers <- r.Peers:
+		case a.peerList.NewPeers <- peer.Tag(r.Peers, peer.SourceTracker):
 		case <-stopC:
 		}
 	}
 }
 
 func (a *Announcer) announceStopAndClose() {
+	defer close(a.closedC)
 	stopC := make(chan struct{})
 	go func() {
 		<-time.After(stopEventTimeout)
 		close(stopC)
 	}()
 	a.announce(tracker.EventStopped, stopC)
-	a.tracker.Close()
+	// Guard against Run's stopC case and a direct call racing each other;
+	// either way tracker.Close must run exactly once.
+	a.closeOnce.Do(a.tracker.Close)
 }
@@ -0,0 +1,217 @@
+package announcer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/cenkalti/rain/internal/logger"
+	"github.com/cenkalti/rain/internal/peer"
+	"github.com/cenkalti/rain/internal/peerlist"
+	"github.com/cenkalti/rain/internal/tracker"
+)
+
+// TrackerGroup announces to a tiered list of trackers, as found in the
+// announce-list of a .torrent file (BEP 12, Multitracker Metadata
+// Extension). Each tier runs its own goroutine: trackers within a tier are
+// tried in order, a tracker is promoted to the head of its tier once it
+// announces successfully, and a tier only reports an error once every
+// tracker in it has failed.
+type TrackerGroup struct {
+	tiers []*tier
+}
+
+// NewTrackerGroup builds a TrackerGroup from a BEP 12 announce-list: a slice
+// of tiers, each a fallback chain of trackers.
+func NewTrackerGroup(tiers [][]tracker.Tracker, requests chan *Request, completedC chan struct{}, pl *peerlist.PeerList, l logger.Logger) *TrackerGroup {
+	g := &TrackerGroup{tiers: make([]*tier, len(tiers))}
+	for i, trackers := range tiers {
+		g.tiers[i] = newTier(trackers, requests, completedC, pl, l)
+	}
+	return g
+}
+
+// Run starts one goroutine per tier and blocks until every tier has
+// returned, which happens once stopC is closed. Returning from Run does not
+// wait for tiers' stopped-event announces, which continue in the
+// background; see Closed.
+func (g *TrackerGroup) Run(stopC chan struct{}) {
+	done := make(chan struct{}, len(g.tiers))
+	for _, t := range g.tiers {
+		t := t
+		go func() {
+			t.run(stopC)
+			done <- struct{}{}
+		}()
+	}
+	for range g.tiers {
+		<-done
+	}
+}
+
+// Closed returns a channel that is closed once every tier's stopped-event
+// announce has finished (or been abandoned after stopEventTimeout).
+func (g *TrackerGroup) Closed() <-chan struct{} {
+	c := make(chan struct{})
+	go func() {
+		for _, t := range g.tiers {
+			<-t.closedC
+		}
+		close(c)
+	}()
+	return c
+}
+
+// tier is one announce-list tier: a fallback chain of trackers tried in
+// order until one of them succeeds.
+type tier struct {
+	trackers   []*tierTracker
+	requests   chan *Request
+	completedC chan struct{}
+	peerList   *peerlist.PeerList
+	log        logger.Logger
+
+	closeOnce sync.Once
+	closedC   chan struct{}
+}
+
+type tierTracker struct {
+	tracker tracker.Tracker
+	backoff backoff.BackOff
+	// nextTry is when this tracker may be tried again after it last failed;
+	// the zero value means it is eligible immediately. Tracked per-tracker
+	// so a tracker that fails but isn't the last one tried in a tier (the
+	// tier as a whole still succeeds via a later tracker) still backs off,
+	// instead of being retried on every single tier announce.
+	nextTry time.Time
+}
+
+func newTier(trackers []tracker.Tracker, requests chan *Request, completedC chan struct{}, pl *peerlist.PeerList, l logger.Logger) *tier {
+	ts := make([]*tierTracker, len(trackers))
+	for i, trk := range trackers {
+		ts[i] = &tierTracker{tracker: trk, backoff: newBackOff()}
+	}
+	// BEP 12: randomize the order of trackers within a tier on startup.
+	rand.Shuffle(len(ts), func(i, j int) { ts[i], ts[j] = ts[j], ts[i] })
+	return &tier{
+		trackers:   ts,
+		requests:   requests,
+		completedC: completedC,
+		peerList:   pl,
+		log:        l,
+		closedC:    make(chan struct{}),
+	}
+}
+
+func (t *tier) run(stopC chan struct{}) {
+	var nextAnnounce time.Duration
+	nextAnnounce = t.announce(tracker.EventStarted, stopC)
+	completedC := t.completedC
+	for {
+		select {
+		case <-time.After(nextAnnounce):
+			nextAnnounce = t.announce(tracker.EventNone, stopC)
+		case <-completedC:
+			t.announce(tracker.EventCompleted, stopC)
+			completedC = nil
+		case <-stopC:
+			// Return immediately so the tier's goroutine doesn't block the
+			// torrent on the stopped-event announce; it runs in the
+			// background, bounded by stopEventTimeout, and closedC reports
+			// when every tracker in the tier is done.
+			go t.announceStopAndClose()
+			return
+		}
+	}
+}
+
+func (t *tier) announceStopAndClose() {
+	defer close(t.closedC)
+	stopC := make(chan struct{})
+	go func() {
+		<-time.After(stopEventTimeout)
+		close(stopC)
+	}()
+	// BEP 12 doesn't require announcing "stopped" to every tracker in the
+	// tier, only the one currently in use.
+	t.announce(tracker.EventStopped, stopC)
+	t.closeOnce.Do(func() {
+		for _, tt := range t.trackers {
+			tt.tracker.Close()
+		}
+	})
+}
+
+// announce tries each tracker in the tier in order, starting with the one
+// currently at the head, skipping any still backed off from a previous
+// failure, and returns the interval to wait before the next announce. A
+// tracker that answers successfully is promoted to the head of the tier and
+// has its own backoff reset; one that fails has its own backoff advanced,
+// so it is left alone on subsequent tier announces even if a later tracker
+// in the tier succeeds. Only when no tracker succeeds and at least one was
+// actually tried (the others still backed off from earlier failures) is a
+// tier-level error logged; either way the wait until
+// the next announce is however long until the soonest tracker in the tier
+// becomes eligible again.
+func (t *tier) announce(e tracker.Event, stopC chan struct{}) time.Duration {
+	now := time.Now()
+	attempted := false
+	for i, tt := range t.trackers {
+		if !tt.nextTry.IsZero() && now.Before(tt.nextTry) {
+			continue
+		}
+		attempted = true
+		req := &Request{Response: make(chan Response)}
+		select {
+		case t.requests <- req:
+		case <-stopC:
+			return t.trackers[0].backoff.NextBackOff()
+		}
+		var resp Response
+		select {
+		case resp = <-req.Response:
+		case <-stopC:
+			return t.trackers[0].backoff.NextBackOff()
+		}
+		r, err := tt.tracker.Announce(resp.Transfer, e, stopC)
+		if err != nil {
+			tt.nextTry = time.Now().Add(tt.backoff.NextBackOff())
+			t.log.Debugln("tracker announce error, trying next tracker in tier:", err)
+			continue
+		}
+		tt.backoff.Reset()
+		tt.nextTry = time.Time{}
+		if i != 0 {
+			// BEP 12: promote the tracker that just succeeded to the head of the tier.
+			t.trackers[0], t.trackers[i] = t.trackers[i], t.trackers[0]
+		}
+		select {
+		case t.peerList.NewPeers <- peer.Tag(r.Peers, peer.SourceTracker):
+		case <-stopC:
+		}
+		return r.Interval
+	}
+	if attempted {
+		t.log.Errorln("announce error: all trackers in tier failed")
+	}
+	return t.nextEligibleIn(now)
+}
+
+// nextEligibleIn returns how long until the soonest tracker in the tier
+// becomes eligible to try again, used to pace the next announce after every
+// tracker either failed or was already in its own backoff window. It never
+// calls a tracker's backoff.NextBackOff itself, so it doesn't double-advance
+// the backoff a failed tracker already advanced this round.
+func (t *tier) nextEligibleIn(now time.Time) time.Duration {
+	earliest := t.trackers[0].nextTry
+	for _, tt := range t.trackers[1:] {
+		if tt.nextTry.Before(earliest) {
+			earliest = tt.nextTry
+		}
+	}
+	if d := earliest.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,19 @@
+package announcer
+
+import "context"
+
+// WaitClosed blocks until every given channel is closed or ctx is done,
+// whichever comes first. It is meant for a top-level Client.Shutdown(ctx)
+// to wait for the stopped-event announces of every tracker of every
+// torrent (each Announcer.Closed() / TrackerGroup.Closed()) without itself
+// blocking torrent.Stop(), which stays fast.
+func WaitClosed(ctx context.Context, closed ...<-chan struct{}) error {
+	for _, c := range closed {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
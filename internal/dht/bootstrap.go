@@ -0,0 +1,27 @@
+package dht
+
+import "net"
+
+// ResolveBootstrapNodes turns the host/port pairs found in a .torrent file's
+// "nodes"/"nodes6" key, or a magnet link's "dht" query parameters, into
+// addresses suitable for DHT.New's bootstrapNodes argument. Hosts that fail
+// to resolve are skipped rather than failing the whole torrent.
+func ResolveBootstrapNodes(hostPorts [][2]interface{}) []*net.UDPAddr {
+	addrs := make([]*net.UDPAddr, 0, len(hostPorts))
+	for _, hp := range hostPorts {
+		host, ok := hp[0].(string)
+		if !ok {
+			continue
+		}
+		port, ok := hp[1].(int64)
+		if !ok {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			continue
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: ips[0], Port: int(port)})
+	}
+	return addrs
+}
@@ -0,0 +1,229 @@
+// Package dht implements enough of the Mainline DHT (BEP 5) for rain to use
+// it as a trackerless peer source: a Kademlia routing table plus
+// ping/find_node/get_peers/announce_peer exchanged as bencoded KRPC
+// messages over UDP. It is wired in alongside announcer.Announcer, feeding
+// discovered addresses into the same peerlist.PeerList.
+package dht
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cenkalti/rain/internal/logger"
+	"github.com/cenkalti/rain/internal/peer"
+	"github.com/cenkalti/rain/internal/peerlist"
+	"github.com/zeebo/bencode"
+)
+
+// minGetPeersInterval caps how often we re-run get_peers for the same
+// infohash, even if a tracker/node suggested a shorter interval.
+const minGetPeersInterval = 5 * time.Minute
+
+// DHT is a single node participating in the Mainline DHT, scoped to one
+// torrent's infohash.
+type DHT struct {
+	self     ID
+	infoHash ID
+	private  bool // metainfo "private" flag; when true, DHT is not used at all
+
+	conn  *net.UDPConn
+	table *RoutingTable
+
+	bootstrapNodes []*net.UDPAddr // pinged once Run starts, so they're added under their real ID
+
+	peerList *peerlist.PeerList
+	log      logger.Logger
+
+	transactions *transactionTable
+}
+
+// New creates a DHT node for a torrent. bootstrapNodes is the initial set of
+// addresses to seed the routing table with, typically parsed from the
+// "nodes"/"nodes6" keys of a .torrent file or a magnet link's `dht=` hint.
+// If private is true, New returns nil: private torrents must not use the
+// DHT at all.
+func New(infoHash ID, private bool, bootstrapNodes []*net.UDPAddr, pl *peerlist.PeerList, l logger.Logger) (*DHT, error) {
+	if private {
+		return nil, nil
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("dht: cannot listen: %w", err)
+	}
+	d := &DHT{
+		self:           newID(),
+		infoHash:       infoHash,
+		private:        private,
+		conn:           conn,
+		bootstrapNodes: bootstrapNodes,
+		peerList:       pl,
+		log:            l,
+		transactions:   newTransactionTable(),
+	}
+	d.table = NewRoutingTable(d.self)
+	return d, nil
+}
+
+// Run drives the DHT node until stopC is closed: it reads incoming packets,
+// bootstraps and periodically refreshes get_peers lookups against our
+// infohash, and announces ourselves to the first node that hands us a token.
+//
+// Incoming packets are handled by readLoop in its own goroutine, never by
+// this one: every query this node sends (Ping, getPeers, announcePeer)
+// blocks in query() waiting for its reply, and that reply is only ever
+// delivered by handlePacket. If handlePacket instead ran on this goroutine,
+// it could never be reached while Run was itself blocked inside one of
+// those queries, and no query this node sends would ever get answered.
+func (d *DHT) Run(stopC chan struct{}) {
+	if d == nil {
+		return // private torrent, New returned nil
+	}
+	defer d.conn.Close()
+
+	go d.readLoop(stopC)
+
+	// Bootstrap addresses don't come with a known ID; only add them to the
+	// table once a successful Ping resolves their real one, so bucket
+	// placement (computed from XOR distance to n.ID) stays correct.
+	for _, addr := range d.bootstrapNodes {
+		d.Ping(addr, stopC)
+	}
+
+	d.getPeers(stopC)
+	ticker := time.NewTicker(minGetPeersInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.getPeers(stopC)
+		case <-stopC:
+			return
+		}
+	}
+}
+
+type packet struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// readLoop reads incoming packets and handles them inline, independent of
+// whatever Run's goroutine happens to be doing. handlePacket never blocks
+// on the network itself (transactions.deliver is a non-blocking send and
+// replies are written without waiting for an answer), so it is safe to
+// call directly from here rather than handing packets off to Run's loop.
+// d.conn.Close(), deferred in Run, unblocks ReadFromUDP once stopC fires.
+func (d *DHT) readLoop(stopC chan struct{}) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		d.handlePacket(packet{data: b, addr: addr})
+		select {
+		case <-stopC:
+			return
+		default:
+		}
+	}
+}
+
+func (d *DHT) handlePacket(p packet) {
+	var msg message
+	if err := bencode.DecodeBytes(p.data, &msg); err != nil {
+		d.log.Debugln("dht: cannot decode packet:", err)
+		return
+	}
+	switch msg.Y {
+	case "r", "e":
+		d.transactions.deliver(msg.T, msg)
+	case "q":
+		d.handleQuery(msg, p.addr)
+	}
+}
+
+// getPeers runs an iterative get_peers lookup against the infohash,
+// starting from the nodes currently closest to it in our table, then
+// querying every node those replies return, for at most 8 rounds or until a
+// round turns up no node not already queried. Any peer addresses found are
+// pushed to peerList tagged as coming from the DHT, and we announce
+// ourselves to the first node whose reply carries a token.
+func (d *DHT) getPeers(stopC chan struct{}) {
+	queried := make(map[string]struct{})
+	frontier := d.table.Closest(d.infoHash, bucketSize)
+	var announced bool
+	for round := 0; round < 8 && len(frontier) > 0; round++ {
+		var next []*Node
+		for _, n := range frontier {
+			if _, ok := queried[n.Addr.String()]; ok {
+				continue
+			}
+			queried[n.Addr.String()] = struct{}{}
+			resp, token, peers, closer, err := d.queryGetPeers(n, stopC)
+			if err != nil {
+				n.failCount++
+				continue
+			}
+			n.failCount = 0
+			d.table.Add(n)
+			if len(peers) > 0 {
+				select {
+				case d.peerList.NewPeers <- peer.Tag(peers, peer.SourceDHT):
+				case <-stopC:
+					return
+				}
+			}
+			if !announced && token != "" {
+				d.announcePeer(n, token, stopC)
+				announced = true
+			}
+			next = append(next, closer...)
+			_ = resp
+		}
+		frontier = next
+	}
+}
+
+// queryGetPeers sends a single get_peers query and parses its response,
+// returning any compact peer addresses and any closer nodes to continue the
+// iterative lookup with.
+func (d *DHT) queryGetPeers(n *Node, stopC chan struct{}) (getPeersResponse, string, []*net.TCPAddr, []*Node, error) {
+	args := getPeersArgs{ID: d.self, InfoHash: d.infoHash}
+	reply, err := d.query(n.Addr, "get_peers", args, stopC)
+	if err != nil {
+		return getPeersResponse{}, "", nil, nil, err
+	}
+	var resp getPeersResponse
+	if err := decodeInto(reply.R, &resp); err != nil {
+		return getPeersResponse{}, "", nil, nil, err
+	}
+	peers := decodeCompactPeers(resp.Values)
+	closer := decodeCompactNodes(resp.Nodes)
+	return resp, resp.Token, peers, closer, nil
+}
+
+func (d *DHT) announcePeer(n *Node, token string, stopC chan struct{}) {
+	args := announcePeerArgs{ID: d.self, ImpliedPort: 1, InfoHash: d.infoHash, Token: token}
+	if _, err := d.query(n.Addr, "announce_peer", args, stopC); err != nil {
+		d.log.Debugln("dht: announce_peer failed:", err)
+	}
+}
+
+// Ping sends a ping query to addr and reports whether it answered, adding
+// it to the routing table on success. Run uses it to verify bootstrap nodes.
+func (d *DHT) Ping(addr *net.UDPAddr, stopC chan struct{}) bool {
+	reply, err := d.query(addr, "ping", pingArgs{ID: d.self}, stopC)
+	if err != nil {
+		return false
+	}
+	var resp idResponse
+	if err := decodeInto(reply.R, &resp); err != nil {
+		return false
+	}
+	d.table.Add(&Node{ID: resp.ID, Addr: addr})
+	return true
+}
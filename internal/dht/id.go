@@ -0,0 +1,39 @@
+package dht
+
+import (
+	"crypto/rand"
+	"math/bits"
+)
+
+// idLength is the size in bytes of a DHT node ID / infohash, per BEP 5.
+const idLength = 20
+
+// ID is a 160-bit Kademlia node ID or BitTorrent infohash.
+type ID [idLength]byte
+
+// newID generates a random ID, used for our own node ID.
+func newID() ID {
+	var id ID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+// distance returns the XOR (Kademlia) distance between two IDs.
+func distance(a, b ID) ID {
+	var d ID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// leadingZeros returns the number of leading zero bits in the ID, i.e. the
+// bucket index to which a node at this distance from us belongs.
+func (id ID) leadingZeros() int {
+	for i, b := range id {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return idLength * 8
+}
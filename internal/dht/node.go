@@ -0,0 +1,21 @@
+package dht
+
+import "net"
+
+// Node is a single entry in the routing table: a peer's DHT node ID and the
+// UDP address it was last seen at.
+type Node struct {
+	ID   ID
+	Addr *net.UDPAddr
+
+	lastSeen  int64 // unix seconds; nothing in this package sets or reads it
+	failCount int   // consecutive queries this node failed to answer
+}
+
+// Good reports whether a node is still considered usable: it hasn't failed
+// too many consecutive queries in a row. Kademlia keeps trying a
+// non-responsive node a few times before evicting it, since a single
+// dropped UDP packet shouldn't cost it its place in the table.
+func (n *Node) Good() bool {
+	return n.failCount < 3
+}
@@ -0,0 +1,61 @@
+package dht
+
+// The KRPC wire format (BEP 5): every UDP packet is a bencoded dict with a
+// transaction id "t", a message type "y" ("q" query, "r" response, "e"
+// error), and type-specific fields. We decode into a generic envelope first
+// and re-decode "a"/"r" into the concrete argument/response struct once we
+// know the query name, since bencode (like JSON) can't type-switch on a
+// sibling field.
+
+type message struct {
+	T string                 `bencode:"t"`
+	Y string                 `bencode:"y"`
+	Q string                 `bencode:"q,omitempty"`
+	A map[string]interface{} `bencode:"a,omitempty"`
+	R map[string]interface{} `bencode:"r,omitempty"`
+	E []interface{}          `bencode:"e,omitempty"`
+}
+
+// pingArgs/pingResponse, findNodeArgs/findNodeResponse, etc. mirror the
+// argument and response dicts defined by BEP 5. Compact nodes are one flat
+// byte string, 26 bytes per IPv4 node (20 byte ID + 6 byte compact
+// address); compact peers ("values") are a bencoded list of separate
+// 6-byte strings (compact address only), one per peer.
+
+type pingArgs struct {
+	ID ID `bencode:"id"`
+}
+
+type findNodeArgs struct {
+	ID     ID `bencode:"id"`
+	Target ID `bencode:"target"`
+}
+
+type findNodeResponse struct {
+	ID    ID     `bencode:"id"`
+	Nodes []byte `bencode:"nodes"`
+}
+
+type getPeersArgs struct {
+	ID       ID `bencode:"id"`
+	InfoHash ID `bencode:"info_hash"`
+}
+
+type getPeersResponse struct {
+	ID     ID       `bencode:"id"`
+	Token  string   `bencode:"token"`
+	Nodes  []byte   `bencode:"nodes,omitempty"`
+	Values [][]byte `bencode:"values,omitempty"`
+}
+
+type announcePeerArgs struct {
+	ID          ID     `bencode:"id"`
+	ImpliedPort int    `bencode:"implied_port"`
+	InfoHash    ID     `bencode:"info_hash"`
+	Port        int    `bencode:"port"`
+	Token       string `bencode:"token"`
+}
+
+type idResponse struct {
+	ID ID `bencode:"id"`
+}
@@ -0,0 +1,169 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// queryTimeout bounds how long we wait for a reply to a query before
+// treating the node as unreachable for this round.
+const queryTimeout = 2 * time.Second
+
+// transactionTable tracks outstanding queries by their transaction id so
+// replies, which arrive asynchronously on the shared UDP socket, can be
+// routed back to the goroutine waiting on them.
+type transactionTable struct {
+	mu      sync.Mutex
+	next    uint32
+	pending map[string]chan message
+}
+
+func newTransactionTable() *transactionTable {
+	return &transactionTable{pending: make(map[string]chan message)}
+}
+
+func (t *transactionTable) register() (string, chan message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	id := fmt.Sprintf("%x", t.next)
+	c := make(chan message, 1)
+	t.pending[id] = c
+	return id, c
+}
+
+func (t *transactionTable) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, id)
+}
+
+func (t *transactionTable) deliver(id string, msg message) {
+	t.mu.Lock()
+	c, ok := t.pending[id]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case c <- msg:
+	default:
+	}
+}
+
+// query sends a KRPC query to addr and waits for its reply, up to
+// queryTimeout or until stopC is closed.
+func (d *DHT) query(addr *net.UDPAddr, q string, args interface{}, stopC chan struct{}) (message, error) {
+	a, err := argsToMap(args)
+	if err != nil {
+		return message{}, err
+	}
+	id, replyC := d.transactions.register()
+	defer d.transactions.forget(id)
+
+	b, err := bencode.EncodeBytes(message{T: id, Y: "q", Q: q, A: a})
+	if err != nil {
+		return message{}, err
+	}
+	if _, err := d.conn.WriteToUDP(b, addr); err != nil {
+		return message{}, err
+	}
+	select {
+	case reply := <-replyC:
+		if reply.Y == "e" {
+			return message{}, fmt.Errorf("dht: %s error: %v", q, reply.E)
+		}
+		return reply, nil
+	case <-time.After(queryTimeout):
+		return message{}, fmt.Errorf("dht: %s to %s timed out", q, addr)
+	case <-stopC:
+		return message{}, fmt.Errorf("dht: stopped")
+	}
+}
+
+// handleQuery answers incoming queries from other nodes with just our own
+// ID, and adds the querying node to our table under its real ID, decoded
+// from the query's "id" argument. rain acts as a minimal responder so it
+// plays nicely in other nodes' routing tables; it does not answer
+// find_node/get_peers with real results or store announce_peer data for
+// others, since it isn't acting as a full DHT server.
+func (d *DHT) handleQuery(msg message, addr *net.UDPAddr) {
+	switch msg.Q {
+	case "ping", "find_node", "get_peers", "announce_peer":
+		var args pingArgs // every query type carries "id"; pingArgs is enough to decode it
+		if err := decodeInto(msg.A, &args); err == nil {
+			d.table.Add(&Node{ID: args.ID, Addr: addr})
+		}
+		d.reply(msg, addr, idResponse{ID: d.self})
+	}
+}
+
+func (d *DHT) reply(msg message, addr *net.UDPAddr, r interface{}) {
+	m, err := argsToMap(r)
+	if err != nil {
+		return
+	}
+	b, err := bencode.EncodeBytes(message{T: msg.T, Y: "r", R: m})
+	if err != nil {
+		return
+	}
+	_, _ = d.conn.WriteToUDP(b, addr)
+}
+
+func argsToMap(v interface{}) (map[string]interface{}, error) {
+	b, err := bencode.EncodeBytes(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := bencode.DecodeBytes(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func decodeInto(m map[string]interface{}, v interface{}) error {
+	b, err := bencode.EncodeBytes(m)
+	if err != nil {
+		return err
+	}
+	return bencode.DecodeBytes(b, v)
+}
+
+// decodeCompactNodes parses the 26-bytes-per-node "nodes" string (20 byte
+// ID + 4 byte IPv4 + 2 byte port) from a find_node/get_peers response.
+func decodeCompactNodes(b []byte) []*Node {
+	const stride = idLength + 6
+	n := len(b) / stride
+	nodes := make([]*Node, 0, n)
+	for i := 0; i < n; i++ {
+		o := b[i*stride:]
+		var id ID
+		copy(id[:], o[:idLength])
+		ip := net.IPv4(o[idLength], o[idLength+1], o[idLength+2], o[idLength+3])
+		port := binary.BigEndian.Uint16(o[idLength+4:])
+		nodes = append(nodes, &Node{ID: id, Addr: &net.UDPAddr{IP: ip, Port: int(port)}})
+	}
+	return nodes
+}
+
+// decodeCompactPeers parses the "values" list of the get_peers response: a
+// bencoded list of 6-byte compact IPv4 peer addresses, one per entry (BEP
+// 5), not a single concatenated byte string. Malformed entries are skipped.
+func decodeCompactPeers(values [][]byte) []*net.TCPAddr {
+	peers := make([]*net.TCPAddr, 0, len(values))
+	for _, o := range values {
+		if len(o) != 6 {
+			continue
+		}
+		ip := net.IPv4(o[0], o[1], o[2], o[3])
+		port := binary.BigEndian.Uint16(o[4:])
+		peers = append(peers, &net.TCPAddr{IP: ip, Port: int(port)})
+	}
+	return peers
+}
@@ -0,0 +1,98 @@
+package dht
+
+import "sync"
+
+// bucketSize is "k" in the Kademlia paper: the maximum number of nodes kept
+// per bucket.
+const bucketSize = 8
+
+// numBuckets is one per bit of the ID space, bucket i holding nodes whose
+// distance from us has exactly i leading zero bits.
+const numBuckets = idLength * 8
+
+// RoutingTable is a simple Kademlia routing table: nodes are bucketed by
+// how many leading bits of their ID match ours, and each bucket keeps at
+// most bucketSize nodes; see Add for what happens when a bucket is full.
+type RoutingTable struct {
+	self ID
+
+	mu      sync.Mutex
+	buckets [numBuckets][]*Node
+}
+
+// NewRoutingTable creates an empty routing table around our own node ID.
+func NewRoutingTable(self ID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+func (t *RoutingTable) bucketIndex(id ID) int {
+	i := distance(t.self, id).leadingZeros()
+	if i >= numBuckets {
+		i = numBuckets - 1
+	}
+	return i
+}
+
+// Add inserts or refreshes a node in the table. If the node's bucket is
+// full, the first node in it that is no longer Good (if any) is replaced;
+// otherwise the new node is dropped, favoring already-known-good nodes as
+// Kademlia recommends.
+func (t *RoutingTable) Add(n *Node) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := t.bucketIndex(n.ID)
+	bucket := t.buckets[i]
+	for j, existing := range bucket {
+		if existing.ID == n.ID {
+			bucket[j] = n
+			return
+		}
+	}
+	if len(bucket) < bucketSize {
+		t.buckets[i] = append(bucket, n)
+		return
+	}
+	for j, existing := range bucket {
+		if !existing.Good() {
+			bucket[j] = n
+			return
+		}
+	}
+	// Bucket full of good nodes; per Kademlia, drop the new node rather than
+	// displace one that is still responding.
+}
+
+// Closest returns up to count nodes closest to id, across the whole table.
+func (t *RoutingTable) Closest(id ID, count int) []*Node {
+	t.mu.Lock()
+	all := make([]*Node, 0, bucketSize*4)
+	for _, bucket := range t.buckets {
+		all = append(all, bucket...)
+	}
+	t.mu.Unlock()
+
+	// Simple selection sort over a normally small candidate set; the table
+	// rarely holds more than a few hundred nodes.
+	for i := 0; i < len(all) && i < count; i++ {
+		min := i
+		for j := i + 1; j < len(all); j++ {
+			if less(distance(id, all[j].ID), distance(id, all[min].ID)) {
+				min = j
+			}
+		}
+		all[i], all[min] = all[min], all[i]
+	}
+	if len(all) > count {
+		all = all[:count]
+	}
+	return all
+}
+
+func less(a, b ID) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
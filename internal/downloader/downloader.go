@@ -1,23 +1,47 @@
 package downloader
 
 import (
+	"context"
 	"math/rand"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/rain/internal/downloader/piecedownloader"
 	"github.com/cenkalti/rain/internal/downloader/piecewriter"
+	"github.com/cenkalti/rain/internal/downloader/requeststrategy"
 	"github.com/cenkalti/rain/internal/logger"
 	"github.com/cenkalti/rain/internal/peer"
+	"github.com/cenkalti/rain/internal/ratelimit"
 	"github.com/cenkalti/rain/internal/semaphore"
 	"github.com/cenkalti/rain/internal/torrentdata"
 	"github.com/cenkalti/rain/internal/worker"
+	"golang.org/x/time/rate"
 )
 
 const parallelPieceDownloads = 4
 
 const parallelPieceWrites = 4
 
+// uploadRequestTimeout bounds how long a Request waits on the upload rate
+// limiter before it is rejected as a fairness measure, so one peer camping
+// on the budget cannot starve the others out indefinitely.
+const uploadRequestTimeout = 10 * time.Second
+
+// maxUploadQueueLength caps how many Requests we keep queued per peer
+// before rejecting further ones outright, matching the queue depth common
+// clients use. Without this a slow storage backend or a greedy peer could
+// pile up an unbounded number of goroutines/buffers.
+const maxUploadQueueLength = 250
+
+// downloadRequestTimeout bounds how long an incoming Piece message waits on
+// the download rate limiter before it is forwarded anyway; see
+// SetDownloadLimit. A chunk that has already arrived from the peer isn't
+// worth holding up the piecedownloader for indefinitely just to stay under
+// budget, unlike an upload we haven't started serving yet.
+const downloadRequestTimeout = 10 * time.Second
+
 type Downloader struct {
 	data                   *torrentdata.Data
 	messages               *peer.Messages
@@ -32,6 +56,21 @@ type Downloader struct {
 	errC                   chan error
 	log                    logger.Logger
 	workers                worker.Workers
+	uploadLimiter          atomic.Pointer[ratelimit.Limiter]
+	downloadLimiter        atomic.Pointer[ratelimit.Limiter]
+	uploadQueues           map[*peer.Peer][]peer.Request
+	uploadBusy             map[*peer.Peer]bool
+	uploadDone             chan uploadResult
+
+	prioritiesMu sync.RWMutex
+	priorities   map[uint32]requeststrategy.Priority // piece index; absent means PriorityNormal
+}
+
+// uploadResult reports that a queued upload Request has finished being
+// served (or rejected/failed), so the next queued Request for that peer, if
+// any, can be started.
+type uploadResult struct {
+	peer *peer.Peer
 }
 
 func New(d *torrentdata.Data, m *peer.Messages, errC chan error, l logger.Logger) *Downloader {
@@ -46,7 +85,7 @@ func New(d *torrentdata.Data, m *peer.Messages, errC chan error, l logger.Logger
 		}
 		sortedPieces[i] = &pieces[i]
 	}
-	return &Downloader{
+	dl := &Downloader{
 		data:           d,
 		messages:       m,
 		pieces:         pieces,
@@ -58,7 +97,54 @@ func New(d *torrentdata.Data, m *peer.Messages, errC chan error, l logger.Logger
 		writeResponses: make(chan piecewriter.Response),
 		errC:           errC,
 		log:            l,
+		uploadQueues:   make(map[*peer.Peer][]peer.Request),
+		uploadBusy:     make(map[*peer.Peer]bool),
+		uploadDone:     make(chan uploadResult),
+		priorities:     make(map[uint32]requeststrategy.Priority),
 	}
+	dl.uploadLimiter.Store(ratelimit.New(0, nil))
+	dl.downloadLimiter.Store(ratelimit.New(0, nil))
+	return dl
+}
+
+// SetUploadLimit sets this torrent's upload rate limit in bytes/sec. A
+// bytesPerSec of 0 means unlimited. parent, if non-nil, is a shared global
+// limiter (see ratelimit.NewGlobal) so multiple torrents can draw from one
+// budget in addition to their own. Safe to call while Run is serving
+// uploads: the new Limiter takes effect for the next Wait call onward, it
+// never mutates one a goroutine might already be waiting on.
+func (d *Downloader) SetUploadLimit(bytesPerSec int, parent *rate.Limiter) {
+	d.uploadLimiter.Store(ratelimit.New(bytesPerSec, parent))
+}
+
+// SetDownloadLimit sets this torrent's download rate limit in bytes/sec.
+// See SetUploadLimit for the meaning of parent, when it is safe to call,
+// and why a new Limiter replaces the old one rather than mutating it. The
+// limit is applied as each Piece message is received, in forwardPiece.
+func (d *Downloader) SetDownloadLimit(bytesPerSec int, parent *rate.Limiter) {
+	d.downloadLimiter.Store(ratelimit.New(bytesPerSec, parent))
+}
+
+// SetPriority sets the download priority of a single piece, e.g. so a
+// streaming client can mark the piece it is currently reading as
+// PriorityHigh and the pieces just ahead of it as PriorityReadAhead,
+// ahead of whatever requeststrategy.Decide would otherwise pick by
+// rarity alone. Safe to call concurrently with Run. A piece that has
+// never had its priority set defaults to PriorityNormal.
+func (d *Downloader) SetPriority(index uint32, p requeststrategy.Priority) {
+	d.prioritiesMu.Lock()
+	defer d.prioritiesMu.Unlock()
+	if p == requeststrategy.PriorityNormal {
+		delete(d.priorities, index)
+		return
+	}
+	d.priorities[index] = p
+}
+
+func (d *Downloader) priority(index uint32) requeststrategy.Priority {
+	d.prioritiesMu.RLock()
+	defer d.prioritiesMu.RUnlock()
+	return d.priorities[index]
 }
 
 func (d *Downloader) Run(stopC chan struct{}) {
@@ -102,6 +188,10 @@ func (d *Downloader) Run(stopC chan struct{}) {
 					// TODO handle corrupt piece
 					continue
 				}
+				// In endgame mode this piece may still be requested from
+				// other peers; now that it has actually arrived, cancel
+				// those losing requests instead of leaving them in flight.
+				d.cancelOtherDownloads(pd.Piece.Index, stopC)
 				select {
 				case d.writeRequests <- piecewriter.Request{Piece: pd.Piece, Data: buf}:
 					d.pieces[pd.Piece.Index].writing = true
@@ -165,7 +255,7 @@ func (d *Downloader) Run(stopC chan struct{}) {
 				pe.bytesDownlaodedInChokePeriod += int64(len(msg.Data))
 			}
 			if pd, ok := d.downloads[msg.Peer]; ok {
-				pd.PieceC <- msg
+				d.forwardPiece(pd, msg, stopC)
 			}
 		case msg := <-d.messages.Request:
 			if pe, ok := d.connectedPeers[msg.Peer]; ok {
@@ -174,9 +264,16 @@ func (d *Downloader) Run(stopC chan struct{}) {
 						d.rejectPiece(pe, msg)
 					}
 				} else {
-					go d.sendPiece(pe, msg)
+					d.enqueueUpload(pe, msg, stopC)
 				}
 			}
+		case msg := <-d.messages.Cancel:
+			d.cancelUpload(msg.Peer, msg)
+		case up := <-d.uploadDone:
+			d.uploadBusy[up.peer] = false
+			if pe, ok := d.connectedPeers[up.peer]; ok {
+				d.startNextUpload(pe, up.peer, stopC)
+			}
 		case <-unchokeTimer.C:
 			peers := make([]*Peer, 0, len(d.connectedPeers))
 			for _, pe := range d.connectedPeers {
@@ -228,6 +325,8 @@ func (d *Downloader) Run(stopC chan struct{}) {
 			}
 		case pe := <-d.messages.Disconnect:
 			delete(d.connectedPeers, pe)
+			delete(d.uploadQueues, pe)
+			delete(d.uploadBusy, pe)
 			for i := range d.pieces {
 				delete(d.pieces[i].havingPeers, pe)
 				delete(d.pieces[i].allowedFastPeers, pe)
@@ -239,44 +338,134 @@ func (d *Downloader) Run(stopC chan struct{}) {
 	}
 }
 
+// nextDownload picks the next piece/peer pair to request by delegating to
+// requeststrategy.Decide, which weighs rarity, piece priority and the
+// allowed-fast set, and sizes per-peer pipelining off the peer's
+// bandwidth-delay product. The event loop still drives one
+// piecedownloader.PieceDownloader at a time per free slot in the
+// parallelPieceDownloads semaphore, so only the first decision that isn't
+// already in flight is used; dec.Depth, the BDP-derived pipeline target, is
+// still passed through so that one piecedownloader pipelines its own chunk
+// requests to the depth requeststrategy computed for this peer.
 func (d *Downloader) nextDownload() *piecedownloader.PieceDownloader {
-	sort.Sort(ByAvailability(d.sortedPieces))
-	for _, p := range d.sortedPieces {
-		if d.data.Bitfield().Test(p.Index) {
+	state, peerStates := d.requestStrategyState()
+	for _, dec := range requeststrategy.Decide(state, peerStates) {
+		pe, ok := dec.Peer.(*peer.Peer)
+		if !ok {
 			continue
 		}
-		if len(p.requestedPeers) > 0 {
+		if _, ok := d.downloads[pe]; ok {
 			continue
 		}
-		if p.writing {
+		cp, ok := d.connectedPeers[pe]
+		if !ok {
 			continue
 		}
-		if len(p.havingPeers) == 0 {
-			continue
+		return piecedownloader.New(d.pieces[dec.Piece].Piece, cp.Peer, dec.Depth)
+	}
+	return nil
+}
+
+// forwardPiece applies the download rate limit to an incoming chunk before
+// handing it to pd, without blocking the event loop: Wait runs in its own
+// goroutine, bounded by downloadRequestTimeout, and the eventual send to
+// pd.PieceC is guarded by stopC the same way every other blocking send in
+// this file is.
+func (d *Downloader) forwardPiece(pd *piecedownloader.PieceDownloader, msg peer.Piece, stopC chan struct{}) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), downloadRequestTimeout)
+		defer cancel()
+		if err := d.downloadLimiter.Load().Wait(ctx, len(msg.Data)); err != nil {
+			// The chunk is already here; better to forward it late than to
+			// throw away data we've already paid for over the wire.
+			d.log.Debugln("timed out waiting for download rate limit, forwarding chunk anyway:", err)
 		}
-		// prefer allowed fast peers first
-		for _, pe := range p.havingPeers {
-			if _, ok := p.allowedFastPeers[pe.Peer]; !ok {
-				continue
-			}
-			if _, ok := d.downloads[pe.Peer]; ok {
-				continue
-			}
-			// TODO selecting first peer having the piece, change to more smart decision
-			return piecedownloader.New(p.Piece, pe.Peer)
+		select {
+		case pd.PieceC <- msg:
+		case <-stopC:
 		}
-		for _, pe := range p.havingPeers {
-			if pe.peerChoking {
-				continue
-			}
-			if _, ok := d.downloads[pe.Peer]; ok {
-				continue
+	}()
+}
+
+// cancelOtherDownloads stops every still-in-flight piecedownloader for
+// index other than the one that just delivered it. Only relevant in
+// endgame mode, where requeststrategy.Decide may have handed the same
+// piece to more than one peer at once; outside endgame there is never more
+// than one requestedPeers entry per piece.
+func (d *Downloader) cancelOtherDownloads(index uint32, stopC chan struct{}) {
+	for pe, pd := range d.pieces[index].requestedPeers {
+		delete(d.downloads, pe)
+		delete(d.pieces[index].requestedPeers, pe)
+		select {
+		case pd.CancelC <- struct{}{}:
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// requestStrategyState snapshots the downloader's piece and peer bookkeeping
+// into the plain types requeststrategy.Decide operates on.
+func (d *Downloader) requestStrategyState() (requeststrategy.TorrentState, map[requeststrategy.PeerID]requeststrategy.PeerState) {
+	pieces := make([]requeststrategy.PieceState, len(d.pieces))
+	missing, notHave := 0, 0
+	for i := range d.pieces {
+		p := &d.pieces[i]
+		have := d.data.Bitfield().Test(p.Index)
+		if !have {
+			notHave++
+			if !p.writing && len(p.requestedPeers) == 0 {
+				missing++
 			}
-			// TODO selecting first peer having the piece, change to more smart decision
-			return piecedownloader.New(p.Piece, pe.Peer)
+		}
+		having := make([]requeststrategy.PeerID, 0, len(p.havingPeers))
+		for pe := range p.havingPeers {
+			having = append(having, pe)
+		}
+		allowedFast := make(map[requeststrategy.PeerID]struct{}, len(p.allowedFastPeers))
+		for pe := range p.allowedFastPeers {
+			allowedFast[pe] = struct{}{}
+		}
+		requested := make(map[requeststrategy.PeerID]struct{}, len(p.requestedPeers))
+		for pe := range p.requestedPeers {
+			requested[pe] = struct{}{}
+		}
+		pieces[i] = requeststrategy.PieceState{
+			Index:       p.Index,
+			Have:        have,
+			Writing:     p.writing,
+			Priority:    d.priority(p.Index),
+			HavingPeers: having,
+			AllowedFast: allowedFast,
+			Requested:   requested,
 		}
 	}
-	return nil
+	state := requeststrategy.TorrentState{
+		Pieces:             pieces,
+		MissingCount:       missing,
+		EndgameMinMissing:  4,
+		EndgameCompletion:  0.95,
+		CompletionFraction: 1 - float64(notHave)/float64(len(d.pieces)),
+	}
+
+	peerStates := make(map[requeststrategy.PeerID]requeststrategy.PeerState, len(d.connectedPeers))
+	for p, pe := range d.connectedPeers {
+		// InFlight is 1 while the peer has a piece download running and 0
+		// otherwise; the chunk requests inside that download are not counted.
+		inFlight := 0
+		if _, ok := d.downloads[p]; ok {
+			inFlight = 1
+		}
+		peerStates[p] = requeststrategy.PeerState{
+			ID:      p,
+			Choking: pe.peerChoking,
+			// bytesDownlaodedInChokePeriod is reset every unchokeTimer tick (10s).
+			DownloadRate: float64(pe.bytesDownlaodedInChokePeriod) / 10,
+			RTT:          time.Second, // TODO: measure per-peer RTT instead of assuming one second
+			InFlight:     inFlight,
+		}
+	}
+	return state, peerStates
 }
 
 func (d *Downloader) updateInterestedState(pe *Peer) {
@@ -315,11 +504,87 @@ func (d *Downloader) unchokePeer(pe *Peer) {
 	}
 }
 
+// enqueueUpload queues an incoming Request to be served, rejecting it
+// outright if the peer's queue is already at maxUploadQueueLength rather
+// than letting requests pile up unbounded. A peer without the fast
+// extension gets no Reject message; its excess Request is dropped.
+func (d *Downloader) enqueueUpload(pe *Peer, msg peer.Request, stopC chan struct{}) {
+	q := d.uploadQueues[msg.Peer]
+	if len(q) >= maxUploadQueueLength {
+		if msg.Peer.FastExtension {
+			d.rejectPiece(pe, msg)
+		}
+		return
+	}
+	d.uploadQueues[msg.Peer] = append(q, msg)
+	d.startNextUpload(pe, msg.Peer, stopC)
+}
+
+// cancelUpload removes a not-yet-started Request from the peer's upload
+// queue when a Cancel message for it arrives. A Request already being
+// served runs to completion; there is no way to interrupt a ReadAt/send in
+// progress, and it's about to finish anyway.
+func (d *Downloader) cancelUpload(p *peer.Peer, msg peer.Request) {
+	q := d.uploadQueues[p]
+	for i, queued := range q {
+		if queued.Piece.Index == msg.Piece.Index && queued.Begin == msg.Begin && queued.Length == msg.Length {
+			d.uploadQueues[p] = append(q[:i], q[i+1:]...)
+			return
+		}
+	}
+}
+
+// startNextUpload serves the next queued Request for p, if one is queued
+// and none is already being served, so at most one Request per peer is in
+// flight at a time.
+func (d *Downloader) startNextUpload(pe *Peer, p *peer.Peer, stopC chan struct{}) {
+	if d.uploadBusy[p] {
+		return
+	}
+	q := d.uploadQueues[p]
+	if len(q) == 0 {
+		return
+	}
+	msg := q[0]
+	d.uploadQueues[p] = q[1:]
+	d.uploadBusy[p] = true
+	go func() {
+		d.sendPiece(pe, msg)
+		// Run may have already returned on stopC, in which case nobody is
+		// left to read d.uploadDone; fall through instead of leaking this
+		// goroutine forever.
+		select {
+		case d.uploadDone <- uploadResult{peer: p}:
+		case <-stopC:
+		}
+	}()
+}
+
 func (d *Downloader) sendPiece(pe *Peer, msg peer.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), uploadRequestTimeout)
+	defer cancel()
+	if err := d.uploadLimiter.Load().Wait(ctx, int(msg.Length)); err != nil {
+		// Couldn't get our fair share of the upload budget in time; reject
+		// instead of making the peer wait behind everyone else. Non-fast
+		// peers have no Reject message, so treat this the same as the
+		// ReadAt failure below: log and close rather than stalling silently.
+		if msg.Peer.FastExtension {
+			d.rejectPiece(pe, msg)
+		} else {
+			d.log.Errorln("timed out waiting for upload rate limit, closing connection:", err)
+			msg.Peer.Close()
+		}
+		return
+	}
 	buf := make([]byte, msg.Length)
 	err := msg.Piece.Data.ReadAt(buf, int64(msg.Begin))
 	if err != nil {
-		// TODO handle cannot read piece data for uploading
+		if msg.Peer.FastExtension {
+			d.rejectPiece(pe, msg)
+		} else {
+			d.log.Errorln("cannot read piece data for uploading, closing connection:", err)
+			msg.Peer.Close()
+		}
 		return
 	}
 	msg.Peer.SendPiece(msg.Piece.Index, msg.Begin, buf)
@@ -0,0 +1,194 @@
+// Package requeststrategy decides which piece requests to make next, given
+// the current state of a torrent and its connected peers. It replaces the
+// old fixed-fan-out, one-piece-per-peer scheme in downloader.nextDownload
+// with rarity- and priority-aware piece selection, per-peer request
+// pipelining sized from the peer's bandwidth-delay product, and an endgame
+// mode for the final pieces.
+//
+// The decision function is pure: it takes snapshots of torrent and peer
+// state and returns the requests to make, with no network I/O of its own,
+// so it can be unit tested without driving the downloader's event loop.
+package requeststrategy
+
+import (
+	"sort"
+	"time"
+)
+
+// chunkLength is the standard BitTorrent block size requested within a piece.
+const chunkLength = 16 * 1024
+
+// Priority is the user-facing priority of a piece, e.g. for sequential
+// streaming playback where pieces near the read position must arrive first.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityReadAhead
+	PriorityHigh
+)
+
+// PeerID identifies a peer without this package depending on the peer
+// package itself; callers pass whatever they use as a map key (e.g. *peer.Peer).
+type PeerID interface{}
+
+// PieceState is the subset of a piece's bookkeeping the strategy needs.
+type PieceState struct {
+	Index       uint32
+	Have        bool
+	Writing     bool
+	Priority    Priority
+	HavingPeers []PeerID
+	AllowedFast map[PeerID]struct{}
+	Requested   map[PeerID]struct{}
+}
+
+// PeerState is the subset of a peer's bookkeeping the strategy needs.
+type PeerState struct {
+	ID           PeerID
+	Choking      bool    // true if the peer is choking us
+	DownloadRate float64 // measured bytes/sec received from this peer
+	RTT          time.Duration
+	InFlight     int // chunk requests currently outstanding to this peer
+}
+
+// TorrentState summarizes torrent-wide counters, notably used to decide
+// whether to enter endgame mode.
+type TorrentState struct {
+	Pieces             []PieceState
+	MissingCount       int     // pieces neither completed nor fully requested
+	EndgameMinMissing  int     // enter endgame once MissingCount is at or below this
+	EndgameCompletion  float64 // or once completion fraction reaches this, e.g. 0.95
+	CompletionFraction float64
+}
+
+// Endgame reports whether the torrent state warrants endgame mode, in which
+// the same missing chunks may be requested from more than one peer.
+func (t TorrentState) Endgame() bool {
+	return t.MissingCount <= t.EndgameMinMissing || t.CompletionFraction >= t.EndgameCompletion
+}
+
+// RequestDecision is one piece-from-peer assignment the downloader's event
+// loop should act on. In endgame mode, the same piece may be the subject of
+// more than one RequestDecision, each naming a different Peer; the event
+// loop is responsible for canceling the losers once one of them actually
+// delivers the piece, not this function.
+type RequestDecision struct {
+	Piece uint32
+	Peer  PeerID
+	// Depth is the peer's current pipeline target: the number of chunk
+	// requests that should be outstanding to it at once, from its
+	// bandwidth-delay product. It is the same for every decision against a
+	// given peer in one Decide call; callers size a new piecedownloader's
+	// pipeline from it.
+	Depth int
+}
+
+// Decide returns the set of piece requests to make given the current
+// torrent and peer state. peers must contain an entry for every peer
+// referenced by t.Pieces[i].HavingPeers/AllowedFast.
+func Decide(t TorrentState, peers map[PeerID]PeerState) []RequestDecision {
+	endgame := t.Endgame()
+	depth := pipelineDepth(peers)
+
+	order := make([]*PieceState, 0, len(t.Pieces))
+	for i := range t.Pieces {
+		p := &t.Pieces[i]
+		if p.Have || p.Writing {
+			continue
+		}
+		if !endgame && len(p.Requested) > 0 {
+			continue
+		}
+		order = append(order, p)
+	}
+	sort.Sort(byPriorityThenRarity(order))
+
+	var decisions []RequestDecision
+	for _, p := range order {
+		candidates := candidatePeers(p, peers, endgame)
+		for _, id := range candidates {
+			pd := depth[id]
+			if pd.remaining <= 0 {
+				continue
+			}
+			pd.remaining--
+			decisions = append(decisions, RequestDecision{Piece: p.Index, Peer: id, Depth: pd.target})
+			if !endgame {
+				break // one peer per piece outside endgame
+			}
+		}
+	}
+	return decisions
+}
+
+// candidatePeers returns, for a single piece, the peers worth requesting it
+// from: allowed-fast peers first (even while choked), then unchoked peers
+// that have the piece. Outside endgame, peers already requested for the
+// piece are skipped; in endgame they are kept.
+func candidatePeers(p *PieceState, peers map[PeerID]PeerState, endgame bool) []PeerID {
+	var fast, normal []PeerID
+	for _, id := range p.HavingPeers {
+		if !endgame {
+			if _, already := p.Requested[id]; already {
+				continue
+			}
+		}
+		ps, ok := peers[id]
+		if !ok {
+			continue
+		}
+		if _, ok := p.AllowedFast[id]; ok {
+			fast = append(fast, id)
+			continue
+		}
+		if ps.Choking {
+			continue
+		}
+		normal = append(normal, id)
+	}
+	return append(fast, normal...)
+}
+
+// pipelineTarget is a peer's computed pipeline depth: target is the
+// bandwidth-delay-product-sized goal, remaining is how much of that is not
+// already accounted for by in-flight requests and is still available for
+// Decide to hand out this call.
+type pipelineTarget struct {
+	target    int
+	remaining int
+}
+
+// pipelineDepth computes, for every known peer, its pipeline target and how
+// many additional chunk requests may be outstanding to it right now. The
+// target depth is the peer's bandwidth-delay product (download rate * RTT)
+// expressed in chunks, so a fast, high-latency peer gets a deeper pipeline
+// than a slow, low-latency one, rather than sharing one fixed-size
+// semaphore across all peers.
+func pipelineDepth(peers map[PeerID]PeerState) map[PeerID]*pipelineTarget {
+	depth := make(map[PeerID]*pipelineTarget, len(peers))
+	for id, ps := range peers {
+		bdp := ps.DownloadRate * ps.RTT.Seconds()
+		target := int(bdp / chunkLength)
+		if target < 1 {
+			target = 1
+		}
+		remaining := target - ps.InFlight
+		if remaining < 0 {
+			remaining = 0
+		}
+		depth[id] = &pipelineTarget{target: target, remaining: remaining}
+	}
+	return depth
+}
+
+type byPriorityThenRarity []*PieceState
+
+func (s byPriorityThenRarity) Len() int      { return len(s) }
+func (s byPriorityThenRarity) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPriorityThenRarity) Less(i, j int) bool {
+	if s[i].Priority != s[j].Priority {
+		return s[i].Priority > s[j].Priority // higher priority first
+	}
+	return len(s[i].HavingPeers) < len(s[j].HavingPeers) // rarest first
+}
@@ -0,0 +1,44 @@
+package requeststrategy
+
+import "testing"
+
+// TestDecideEndgameRacesInsteadOfChurning checks that endgame mode can have
+// more than one in-flight request for the same piece at once: a piece that
+// already has one peer in p.Requested must still get a decision for a
+// second candidate peer, racing the two rather than replacing the first.
+// Canceling the loser belongs to the event loop once one request actually
+// delivers the piece, which is why RequestDecision carries no Cancel list.
+func TestDecideEndgameRacesInsteadOfChurning(t *testing.T) {
+	piece := PieceState{
+		Index:       0,
+		HavingPeers: []PeerID{"peerA", "peerB"},
+		Requested:   map[PeerID]struct{}{"peerA": {}},
+	}
+	state := TorrentState{
+		Pieces:            []PieceState{piece},
+		MissingCount:      1,
+		EndgameMinMissing: 1, // force endgame
+	}
+	peers := map[PeerID]PeerState{
+		"peerA": {ID: "peerA", DownloadRate: 32 * 1024, RTT: 0},
+		"peerB": {ID: "peerB", DownloadRate: 32 * 1024, RTT: 0},
+	}
+
+	decisions := Decide(state, peers)
+
+	var sawA, sawB bool
+	for _, d := range decisions {
+		if d.Piece != 0 {
+			t.Fatalf("unexpected piece in decision: %+v", d)
+		}
+		switch d.Peer {
+		case "peerA":
+			sawA = true
+		case "peerB":
+			sawB = true
+		}
+	}
+	if !sawA || !sawB {
+		t.Fatalf("endgame mode should race peerB alongside peerA's in-flight request, got decisions: %+v", decisions)
+	}
+}
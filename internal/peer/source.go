@@ -0,0 +1,53 @@
+package peer
+
+import "net"
+
+// Source identifies how a peer was discovered, so that other subsystems
+// (the downloader, the choker, PEX) can make source-aware decisions, e.g.
+// not re-gossiping peers that were themselves learned from PEX.
+type Source int
+
+const (
+	// SourceTracker means the peer address came from an HTTP/UDP tracker announce.
+	SourceTracker Source = iota
+	// SourceIncoming means the peer dialed us.
+	SourceIncoming
+	// SourceDHT means the peer address came from the DHT.
+	SourceDHT
+	// SourcePEX means the peer address was gossiped to us by another peer.
+	SourcePEX
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceIncoming:
+		return "incoming"
+	case SourceDHT:
+		return "dht"
+	case SourcePEX:
+		return "pex"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerAddr pairs a discovered peer address with the Source that produced
+// it. peerlist.PeerList.NewPeers carries these instead of bare *net.TCPAddr
+// so that, once a dial succeeds, the resulting Peer can have its Source
+// recorded for the downloader to later make source-aware decisions.
+type PeerAddr struct {
+	Addr   *net.TCPAddr
+	Source Source
+}
+
+// Tag wraps a batch of freshly discovered addresses with the Source they
+// came from, for producers of peerlist.PeerList.NewPeers.
+func Tag(addrs []*net.TCPAddr, source Source) []PeerAddr {
+	tagged := make([]PeerAddr, len(addrs))
+	for i, addr := range addrs {
+		tagged[i] = PeerAddr{Addr: addr, Source: source}
+	}
+	return tagged
+}
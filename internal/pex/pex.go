@@ -0,0 +1,284 @@
+// Package pex implements Peer Exchange (BEP 11, ut_pex): gossiping the
+// addresses of connected peers between clients that both support the
+// ut_pex extended message, so peers can be discovered without waiting on
+// the tracker or DHT.
+package pex
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/rain/internal/logger"
+	"github.com/cenkalti/rain/internal/peer"
+	"github.com/cenkalti/rain/internal/peerlist"
+	"github.com/zeebo/bencode"
+)
+
+const (
+	// exchangeInterval is how often we send added/dropped updates to each peer, per BEP 11.
+	exchangeInterval = 60 * time.Second
+	// maxPeersPerMessage caps how many peers we advertise in a single added/dropped message.
+	maxPeersPerMessage = 50
+)
+
+// Flag is a per-peer flag byte sent alongside "added" in "added.f".
+type Flag byte
+
+const (
+	FlagEncryption Flag = 0x01
+	FlagSeeder     Flag = 0x02
+	FlagUTP        Flag = 0x04
+	FlagOutgoing   Flag = 0x10
+)
+
+// message is the bencoded payload of the ut_pex extended message.
+type message struct {
+	Added      []byte `bencode:"added"`
+	AddedFlags []byte `bencode:"added.f"`
+	Dropped    []byte `bencode:"dropped"`
+}
+
+// Peer is the subset of peer.Peer that the PEX subsystem needs. It is kept
+// narrow on purpose so this package does not depend on connection internals.
+type Peer interface {
+	TCPAddr() *net.TCPAddr
+	UtPexEnabled() bool
+	SendExtensionMessage(name string, payload []byte) error
+
+	// Seeder, EncryptionEnabled, UTP and Outgoing report the per-peer state
+	// needed to fill in the "added.f" flag byte (BEP 11).
+	Seeder() bool
+	EncryptionEnabled() bool
+	UTP() bool
+	Outgoing() bool
+}
+
+// Exchange runs the PEX subsystem for a single torrent, alongside the
+// downloader's event loop. On each tick it tells every ut_pex capable
+// connected peer about the peers we are connected to, and any peers it
+// learns about from incoming PEX messages are pushed into peerList so the
+// downloader dials them.
+type Exchange struct {
+	connectedPeers func() []Peer
+	peerList       *peerlist.PeerList
+	log            logger.Logger
+
+	// advertised tracks, per peer we've sent PEX messages to, the set of
+	// addresses (by string) we last told it about, so the next tick can
+	// compute an added/dropped diff instead of resending everything.
+	advertised map[Peer]map[string]struct{}
+
+	messages chan incomingMessage
+
+	// lastReceived tracks, per peer, when we last accepted a ut_pex message
+	// from it, so HandleMessage can enforce BEP 11's "no more than once per
+	// minute" limit on the receive side too, not just when we send.
+	lastReceivedMu sync.Mutex
+	lastReceived   map[Peer]time.Time
+}
+
+type incomingMessage struct {
+	from Peer
+	data []byte
+}
+
+// New creates an Exchange. connectedPeers must return the current snapshot
+// of peers connected for the torrent; it is called once per tick.
+func New(connectedPeers func() []Peer, pl *peerlist.PeerList, l logger.Logger) *Exchange {
+	return &Exchange{
+		connectedPeers: connectedPeers,
+		peerList:       pl,
+		log:            l,
+		advertised:     make(map[Peer]map[string]struct{}),
+		messages:       make(chan incomingMessage, 16),
+		lastReceived:   make(map[Peer]time.Time),
+	}
+}
+
+// HandleMessage queues a received ut_pex extended message for processing.
+// It must not block the peer's read loop, so it is safe to call directly
+// from there. Per BEP 11, peers are not supposed to send more than once a
+// minute; a peer that does is throttled here rather than merely risking a
+// drop once the receive queue happens to be full.
+func (e *Exchange) HandleMessage(from Peer, data []byte) {
+	if !e.allowReceive(from) {
+		e.log.Debugln("pex: dropping message, peer exceeded ut_pex receive rate")
+		return
+	}
+	select {
+	case e.messages <- incomingMessage{from: from, data: data}:
+	default:
+		e.log.Debugln("pex: dropping message, receive queue full")
+	}
+}
+
+// allowReceive reports whether it has been at least exchangeInterval since
+// the last ut_pex message we accepted from from, and records now as the
+// new last-received time if so.
+func (e *Exchange) allowReceive(from Peer) bool {
+	e.lastReceivedMu.Lock()
+	defer e.lastReceivedMu.Unlock()
+	now := time.Now()
+	if last, ok := e.lastReceived[from]; ok && now.Sub(last) < exchangeInterval {
+		return false
+	}
+	e.lastReceived[from] = now
+	return true
+}
+
+// Run sends periodic PEX updates to connected peers and processes incoming
+// PEX messages until stopC is closed.
+func (e *Exchange) Run(stopC chan struct{}) {
+	ticker := time.NewTicker(exchangeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.tick()
+		case m := <-e.messages:
+			e.handle(m)
+		case <-stopC:
+			return
+		}
+	}
+}
+
+func (e *Exchange) tick() {
+	peers := e.connectedPeers()
+	current := make(map[string]struct{}, len(peers))
+	for _, p := range peers {
+		current[p.TCPAddr().String()] = struct{}{}
+	}
+	for _, p := range peers {
+		if !p.UtPexEnabled() {
+			continue
+		}
+		e.sendTo(p, peers, current)
+	}
+	// Forget peers we no longer need to diff against (they disconnected).
+	for p := range e.advertised {
+		if _, ok := current[p.TCPAddr().String()]; !ok {
+			delete(e.advertised, p)
+		}
+	}
+	e.lastReceivedMu.Lock()
+	for p := range e.lastReceived {
+		if _, ok := current[p.TCPAddr().String()]; !ok {
+			delete(e.lastReceived, p)
+		}
+	}
+	e.lastReceivedMu.Unlock()
+}
+
+func (e *Exchange) sendTo(p Peer, peers []Peer, current map[string]struct{}) {
+	known := e.advertised[p]
+	if known == nil {
+		known = make(map[string]struct{})
+	}
+	var added, addedFlags, dropped []byte
+	addedCount := 0
+	for _, other := range peers {
+		if other == p {
+			continue
+		}
+		addr := other.TCPAddr().String()
+		if _, ok := known[addr]; ok {
+			continue
+		}
+		if addedCount >= maxPeersPerMessage {
+			break
+		}
+		compact, ok := compactAddr(other.TCPAddr())
+		if !ok {
+			continue
+		}
+		added = append(added, compact...)
+		addedFlags = append(addedFlags, byte(flagsFor(other)))
+		known[addr] = struct{}{}
+		addedCount++
+	}
+	for addr := range known {
+		if _, ok := current[addr]; !ok {
+			if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+				if compact, ok := compactAddr(tcpAddr); ok {
+					dropped = append(dropped, compact...)
+				}
+			}
+			delete(known, addr)
+		}
+	}
+	e.advertised[p] = known
+	if len(added) == 0 && len(dropped) == 0 {
+		return
+	}
+	payload, err := bencode.EncodeBytes(message{Added: added, AddedFlags: addedFlags, Dropped: dropped})
+	if err != nil {
+		e.log.Errorln("pex: cannot encode message:", err)
+		return
+	}
+	if err = p.SendExtensionMessage("ut_pex", payload); err != nil {
+		e.log.Debugln("pex: cannot send message:", err)
+	}
+}
+
+func (e *Exchange) handle(m incomingMessage) {
+	var msg message
+	if err := bencode.DecodeBytes(m.data, &msg); err != nil {
+		e.log.Debugln("pex: cannot decode message:", err)
+		return
+	}
+	addrs := decodeCompactAddrs(msg.Added, maxPeersPerMessage)
+	if len(addrs) == 0 {
+		return
+	}
+	select {
+	case e.peerList.NewPeers <- peer.Tag(addrs, peer.SourcePEX):
+	default:
+		e.log.Debugln("pex: peer list full, dropping peers")
+	}
+}
+
+func flagsFor(p Peer) Flag {
+	var f Flag
+	if p.EncryptionEnabled() {
+		f |= FlagEncryption
+	}
+	if p.Seeder() {
+		f |= FlagSeeder
+	}
+	if p.UTP() {
+		f |= FlagUTP
+	}
+	if p.Outgoing() {
+		f |= FlagOutgoing
+	}
+	return f
+}
+
+func compactAddr(addr *net.TCPAddr) ([]byte, bool) {
+	ip4 := addr.IP.To4()
+	if ip4 == nil {
+		return nil, false
+	}
+	b := make([]byte, 6)
+	copy(b, ip4)
+	b[4] = byte(addr.Port >> 8)
+	b[5] = byte(addr.Port)
+	return b, true
+}
+
+func decodeCompactAddrs(b []byte, max int) []*net.TCPAddr {
+	n := len(b) / 6
+	if n > max {
+		n = max
+	}
+	addrs := make([]*net.TCPAddr, 0, n)
+	for i := 0; i < n; i++ {
+		o := b[i*6:]
+		ip := net.IPv4(o[0], o[1], o[2], o[3])
+		port := int(o[4])<<8 | int(o[5])
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: port})
+	}
+	return addrs
+}
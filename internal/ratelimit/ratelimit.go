@@ -0,0 +1,137 @@
+// Package ratelimit provides token-bucket rate limiting for upload and
+// download traffic, built on golang.org/x/time/rate. A Limiter can be
+// scoped to a single torrent, a shared global budget, or both at once by
+// chaining a per-torrent Limiter off a global *rate.Limiter.
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst floors every limiter's burst at one chunk (16 KiB, the standard
+// BitTorrent block size, the same value as requeststrategy.chunkLength;
+// hardcoded here rather than imported to avoid a layering dependency from
+// this low-level package onto the downloader). rate.Limiter.WaitN/AllowN
+// reject outright when n exceeds the burst, so a burst below one chunk
+// would make every single upload/download request fail instead of being
+// throttled.
+const minBurst = 16 * 1024
+
+func burstFor(bytesPerSec int) int {
+	if bytesPerSec < minBurst {
+		return minBurst
+	}
+	return bytesPerSec
+}
+
+// NewGlobal creates the shared limiter to pass as the parent of every
+// per-torrent Limiter so multiple torrents can draw from one budget. A
+// bytesPerSec of 0 means unlimited, in which case NewGlobal returns nil and
+// every Limiter built from it behaves as if it had no parent.
+func NewGlobal(bytesPerSec int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burstFor(bytesPerSec))
+}
+
+// Limiter limits the rate of a single byte stream (e.g. one torrent's
+// uploads), optionally bounded by a shared parent budget as well.
+type Limiter struct {
+	parent *rate.Limiter // shared across torrents, may be nil
+	own    *rate.Limiter // this torrent's own budget, may be nil if unlimited
+
+	// used counts bytes let through by Wait/Allow, for metrics. It is
+	// torrent-level, not per-peer: this package has no visibility into
+	// which peer a given Wait/Allow call was for.
+	used int64
+}
+
+// New creates a Limiter with its own bytesPerSec budget, chained off parent
+// (which may be nil). A bytesPerSec of 0 means this Limiter itself is
+// unlimited; it still honors parent if one is given.
+func New(bytesPerSec int, parent *rate.Limiter) *Limiter {
+	l := &Limiter{parent: parent}
+	if bytesPerSec > 0 {
+		l.own = rate.NewLimiter(rate.Limit(bytesPerSec), burstFor(bytesPerSec))
+	}
+	return l
+}
+
+// SetLimit changes the per-torrent budget. A bytesPerSec of 0 removes it,
+// making this Limiter unlimited on its own (the parent budget, if any,
+// still applies).
+func (l *Limiter) SetLimit(bytesPerSec int) {
+	if bytesPerSec <= 0 {
+		l.own = nil
+		return
+	}
+	if l.own == nil {
+		l.own = rate.NewLimiter(rate.Limit(bytesPerSec), burstFor(bytesPerSec))
+		return
+	}
+	l.own.SetLimit(rate.Limit(bytesPerSec))
+	l.own.SetBurst(burstFor(bytesPerSec))
+}
+
+// Used returns the total bytes this Limiter has let through via Wait and
+// Allow since it was created, for reporting torrent-level throughput.
+func (l *Limiter) Used() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.used)
+}
+
+// Wait blocks until n bytes may be transferred, honoring both the
+// per-torrent and the shared global budget. Callers must reserve before
+// doing the actual I/O, not after, so bursts match the configured rate
+// instead of trailing it.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	if l.own != nil {
+		if err := l.own.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if l.parent != nil {
+		if err := l.parent.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&l.used, int64(n))
+	return nil
+}
+
+// Allow reports whether n bytes may be transferred right now, without
+// blocking, consuming the budget if so. It lets a caller reject a request
+// outright instead of making a peer wait behind others when the budget is
+// already spoken for; nothing in this repository calls it.
+func (l *Limiter) Allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	var own *rate.Reservation
+	if l.own != nil {
+		own = l.own.ReserveN(now, n)
+		if !own.OK() || own.DelayFrom(now) > 0 {
+			own.CancelAt(now)
+			return false
+		}
+	}
+	if l.parent != nil && !l.parent.AllowN(now, n) {
+		if own != nil {
+			own.CancelAt(now)
+		}
+		return false
+	}
+	atomic.AddInt64(&l.used, int64(n))
+	return true
+}